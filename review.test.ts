@@ -0,0 +1,398 @@
+import { test, type TestContext } from "node:test";
+import assert from "node:assert/strict";
+import { mkdtemp, readFile, rm, writeFile } from "node:fs/promises";
+import { tmpdir } from "node:os";
+import { join } from "node:path";
+import { fileURLToPath } from "node:url";
+import {
+  aggregate,
+  checkBlockedLabels,
+  parseCommandLine,
+  parseReply,
+  parseSelection,
+  replayTranscriptFile,
+  run,
+  RunError,
+  splitAnswers,
+  stats,
+  type Config,
+} from "./review.ts";
+
+// Stand-in claude CLI that plays a stream-json fixture from testdata
+const stubClaude = fileURLToPath(new URL("./testdata/stub-claude.mjs", import.meta.url));
+
+// Path of a testdata fixture
+function fixture(name: string): string {
+  return fileURLToPath(new URL(`./testdata/${name}`, import.meta.url));
+}
+
+// A question with one option per label
+function question(labels: string[], multiSelect = false) {
+  return {
+    question: `Which of ${labels.join(", ")}?`,
+    header: "Pick",
+    multiSelect,
+    options: labels.map((label) => ({ label, description: `${label} description` })),
+  };
+}
+
+const databases = question(["Postgres", "MySQL", "SQLite"]);
+const features = question(["Auth", "Search", "Billing"], true);
+
+// A temporary directory, removed when the test ends
+async function tempDir(t: TestContext): Promise<string> {
+  const dir = await mkdtemp(join(tmpdir(), "review-test-"));
+  t.after(() => rm(dir, { recursive: true, force: true }));
+  return dir;
+}
+
+// Set environment variables for the rest of the test
+function withEnv(t: TestContext, vars: Record<string, string>) {
+  for (const [name, value] of Object.entries(vars)) {
+    const previous = process.env[name];
+    process.env[name] = value;
+    t.after(() => {
+      if (previous === undefined) {
+        delete process.env[name];
+      } else {
+        process.env[name] = previous;
+      }
+    });
+  }
+}
+
+// Config as the command line builds it, without a config file
+async function baseConfig(t: TestContext, ...args: string[]): Promise<Config> {
+  const configFile = join(await tempDir(t), "review.json");
+  await writeFile(configFile, "{}");
+  const { config } = await parseCommandLine(["--config", configFile, "prompt", ...args]);
+  return config;
+}
+
+// Write an executable shell script into a fresh directory and return its path
+async function stub(t: TestContext, name: string, script: string): Promise<string> {
+  const path = join(await tempDir(t), name);
+  await writeFile(path, `#!/bin/sh\n${script}\n`, { mode: 0o755 });
+  return path;
+}
+
+// Replay one AskUserQuestion call and return the --audit records it produced.
+// The answer cache is off, or an earlier test's answers would stand in for the reviewer.
+async function replayQuestions(t: TestContext, questions: any[], config: Config): Promise<any[]> {
+  const dir = await tempDir(t);
+  const transcript = join(dir, "transcript.jsonl");
+  const message = {
+    type: "assistant",
+    message: {
+      content: [{ type: "tool_use", id: "toolu_1", name: "AskUserQuestion", input: { questions } }],
+    },
+  };
+  await writeFile(transcript, JSON.stringify(message) + "\n");
+  const audit = join(dir, "audit.jsonl");
+  await replayTranscriptFile(transcript, { ...config, cache: false, audit });
+  return readJsonLines(audit);
+}
+
+// Parse a file of JSON lines
+async function readJsonLines(path: string): Promise<any[]> {
+  const lines = (await readFile(path, "utf-8")).trim().split("\n");
+  return lines.map((line) => JSON.parse(line));
+}
+
+test("parseSelection reads option numbers, ordinals and labels", () => {
+  const many = question(Array.from({ length: 12 }, (_, i) => `Choice ${i + 1}`));
+  assert.deepEqual(parseSelection("Option 10", many), [9]);
+  assert.deepEqual(parseSelection("the second one", databases), [1]);
+  assert.deepEqual(parseSelection("MySQL", databases), [1]);
+  assert.deepEqual(parseSelection("1, 3", features), [0, 2]);
+});
+
+test("parseSelection prefers a leading number over the reasoning after it", () => {
+  for (const reply of [
+    "2 (the first option is too slow)",
+    "2. Unlike option 1, this scales",
+    "2 because MySQL lacks features",
+  ]) {
+    assert.deepEqual(parseSelection(reply, databases), [1], reply);
+  }
+  assert.deepEqual(parseSelection("1, 3 since option 2 is out of scope", features), [0, 2]);
+});
+
+test("parseSelection reads a leading number that is no option number as prose", () => {
+  const timeouts = question(["30 seconds", "60 seconds"]);
+  assert.deepEqual(parseSelection("60 seconds, since builds are slow", timeouts), [1]);
+  assert.deepEqual(parseSelection("2024 roadmap before the migration", databases), []);
+});
+
+test("--allow-freetext forwards prose that starts with a number", async (t) => {
+  const config = await baseConfig(t, "--allow-freetext");
+  const [selection] = parseReply("2024 roadmap before the migration", [databases], config);
+  assert.deepEqual(selection.indices, []);
+  assert.equal(selection.text, "2024 roadmap before the migration");
+});
+
+test("parseSelection tells options with the same label apart by description", () => {
+  const cache = {
+    question: "Where should the cache live?",
+    header: "Cache",
+    multiSelect: false,
+    options: [
+      { label: "Use cache", description: "Keep entries in memory" },
+      { label: "Use cache", description: "Store entries on disk" },
+    ],
+  };
+  assert.deepEqual(parseSelection('Use cache ("Store entries on disk")', cache), [1]);
+  assert.deepEqual(parseSelection('Use cache, "keep entries in memory"', cache), [0]);
+});
+
+test("splitAnswers assigns labeled lines and fills the rest in order", () => {
+  assert.deepEqual(splitAnswers("2: B\n1: A", 2), ["A", "B"]);
+  assert.deepEqual(splitAnswers("Question 2: B\nA", 2), ["A", "B"]);
+  assert.deepEqual(splitAnswers("first\nsecond\nthird", 2), ["first", "second\nthird"]);
+  assert.deepEqual(splitAnswers("1: A", 3), ["A", "", ""]);
+});
+
+test("parseReply reads one selection per question", async (t) => {
+  const config = await baseConfig(t);
+  const [db, feat] = parseReply("1: 2\n2: 1, 3", [databases, features], config);
+  assert.deepEqual(db.indices, [1]);
+  assert.deepEqual(feat.indices, [0, 2]);
+
+  const [answered] = parseReply("I weighed option 1.\nANSWER: 3", [databases], config);
+  assert.deepEqual(answered.indices, [2]);
+
+  const [confident] = parseReply("CONF:0.4\n1: 2", [databases], config);
+  assert.equal(confident.confidence, 0.4);
+});
+
+test("parseReply ignores numbers in fenced code", async (t) => {
+  const config = await baseConfig(t);
+  const fence = "```";
+  const replies = [
+    `${fence}\nconst retries = 3;\n${fence}\nANSWER: 2`,
+    `Compare:\n${fence}\nlimit = 1\n${fence}\n2`,
+    `${fence}\n2\n${fence}`,
+  ];
+  for (const reply of replies) {
+    const [selection] = parseReply(reply, [databases], config);
+    assert.deepEqual(selection.indices, [1], reply);
+  }
+});
+
+test("parseReply reads full-width digits", async (t) => {
+  const config = await baseConfig(t);
+  const [selection] = parseReply("２", [databases], config);
+  assert.deepEqual(selection.indices, [1]);
+});
+
+test("--answer-first-line reads only the leading answer lines", async (t) => {
+  const config = await baseConfig(t, "--answer-first-line");
+  const [selection] = parseReply("2\nI compared option 3 and Postgres.", [databases], config);
+  assert.deepEqual(selection.indices, [1]);
+
+  const [db, feat] = parseReply("2\n1\nQuestion 1: 3 was tempting", [databases, features], config);
+  assert.deepEqual(db.indices, [1]);
+  assert.deepEqual(feat.indices, [0]);
+});
+
+test("parseReply defaults out-of-range options, including option 0", async (t) => {
+  const config = await baseConfig(t);
+  for (const reply of ["option 0", "0", "7"]) {
+    const [selection] = parseReply(reply, [databases], config);
+    assert.deepEqual(selection.indices, [0], reply);
+  }
+});
+
+test("aggregate takes the confidence-weighted vote", () => {
+  const pick = (indices: number[], confidence?: number) => [{ indices, text: "", confidence }];
+  assert.deepEqual(aggregate([databases], [pick([0]), pick([1]), pick([1])])[0].indices, [1]);
+  assert.deepEqual(
+    aggregate([databases], [pick([0], 0.9), pick([1], 0.3), pick([1], 0.3)])[0].indices,
+    [0]
+  );
+  assert.deepEqual(
+    aggregate([features], [pick([0, 1]), pick([1, 2]), pick([1])])[0].indices,
+    [1]
+  );
+});
+
+test("aggregate counts votes when every pick has zero confidence", () => {
+  const pick = (index: number) => [{ indices: [index], text: "", confidence: 0 }];
+  assert.deepEqual(aggregate([databases], [pick(2), pick(2), pick(1)])[0].indices, [2]);
+});
+
+test("parseCommandLine layers the command line over the config file over defaults", async (t) => {
+  const configFile = join(await tempDir(t), "review.json");
+  await writeFile(configFile, JSON.stringify({ reviewers: 3, "reviewer-timeout": "30s" }));
+  const { config, prompt } = await parseCommandLine([
+    "--config",
+    configFile,
+    "--reviewers",
+    "2",
+    "do the task",
+  ]);
+  assert.equal(prompt, "do the task");
+  assert.equal(config.reviewers, 2);
+  assert.equal(config.reviewerTimeout, 30000);
+  assert.equal(config.reviewerMaxTurns, 10);
+});
+
+test("checkBlockedLabels stops on a blocked label, even one containing a comma", async (t) => {
+  const config = await baseConfig(t, "--block-labels", "drop");
+  const migration = question(["Keep", "Drop, then recreate"], true);
+  const answer = (text: string) => ({ [migration.question]: text });
+  assert.throws(
+    () => checkBlockedLabels([migration], answer("Keep, Drop, then recreate"), config),
+    (error: unknown) => error instanceof RunError && error.kind === "blocked"
+  );
+  assert.doesNotThrow(() => checkBlockedLabels([migration], answer("Keep"), config));
+});
+
+test("the claude reviewer runs read-only and its answer reaches the worker", async (t) => {
+  const argvFile = join(await tempDir(t), "argv");
+  const claude = await stub(t, "claude", `echo "$@" > ${argvFile}\nprintf '1: 2\\n'`);
+  withEnv(t, { REVIEW_CLAUDE_BIN: claude });
+  const [record] = await replayQuestions(t, [databases], await baseConfig(t));
+  assert.equal(record.answer, "MySQL");
+  assert.deepEqual(record.chosen, [1]);
+  const argv = await readFile(argvFile, "utf-8");
+  assert.match(argv, /--allowedTools Read,Glob,Grep/);
+  assert.match(argv, /--disallowedTools AskUserQuestion/);
+});
+
+test("--reviewer-cmd gets the prompt on stdin", async (t) => {
+  const promptFile = join(await tempDir(t), "prompt");
+  const reviewer = await stub(t, "reviewer", `cat > ${promptFile}\nprintf 'ANSWER: 1: 3\\n'`);
+  const config = await baseConfig(t, "--reviewer-cmd", reviewer);
+  const [record] = await replayQuestions(t, [databases], config);
+  assert.equal(record.answer, "SQLite");
+  assert.match(await readFile(promptFile, "utf-8"), /Which of Postgres, MySQL, SQLite\?/);
+});
+
+test("a failed reviewer falls back to the option marked isDefault", async (t) => {
+  const reviewer = await stub(t, "reviewer", "cat > /dev/null\nexit 1");
+  const marked = {
+    ...databases,
+    options: databases.options.map((opt, i) => ({ ...opt, isDefault: i === 2 })),
+  };
+  const config = await baseConfig(t, "--reviewer-cmd", reviewer, "--reviewer-retries", "0");
+  const [record] = await replayQuestions(t, [marked], config);
+  assert.equal(record.answer, "SQLite");
+  assert.equal(record.source, "default");
+});
+
+test("a reviewer that fails twice is retried until it answers", async (t) => {
+  const attempts = join(await tempDir(t), "attempts");
+  const reviewer = await stub(
+    t,
+    "reviewer",
+    `cat > /dev/null\necho x >> ${attempts}\n` +
+      `[ "$(wc -l < ${attempts})" -le 2 ] && exit 1\nprintf 'ANSWER: 1: 2\\n'`
+  );
+  const config = await baseConfig(t, "--reviewer-cmd", reviewer, "--reviewer-retries", "2");
+  const [record] = await replayQuestions(t, [databases], config);
+  assert.equal(record.answer, "MySQL");
+  assert.equal((await readFile(attempts, "utf-8")).trim().split("\n").length, 3);
+  assert.equal(stats.reviewerFailures, 0);
+});
+
+test("--reviewer-timeout kills a stuck reviewer and falls back to the default", async (t) => {
+  const reviewer = await stub(t, "reviewer", "cat > /dev/null\nexec sleep 10");
+  const config = await baseConfig(
+    t,
+    "--reviewer-cmd",
+    reviewer,
+    "--reviewer-timeout",
+    "200ms",
+    "--reviewer-retries",
+    "0"
+  );
+  const started = Date.now();
+  const [record] = await replayQuestions(t, [databases], config);
+  assert.ok(Date.now() - started < 5000);
+  assert.equal(record.answer, "Postgres");
+  assert.equal(record.source, "default");
+  assert.equal(stats.reviewerFailures, 1);
+});
+
+test("--include-rationale asks for reasoning and passes it on", async (t) => {
+  const promptFile = join(await tempDir(t), "prompt");
+  const reply = "ANSWER: 1: 2\\nRATIONALE: prod runs MySQL\\nEXPLANATION: private\\n";
+  const reviewer = await stub(t, "reviewer", `cat > ${promptFile}\nprintf '${reply}'`);
+  const config = await baseConfig(
+    t,
+    "--reviewer-cmd",
+    reviewer,
+    "--include-rationale",
+    "--explain"
+  );
+  const [record] = await replayQuestions(t, [databases], config);
+  assert.equal(record.answer, "MySQL\n\nReviewer rationale: prod runs MySQL");
+  assert.match(await readFile(promptFile, "utf-8"), /RATIONALE:/);
+});
+
+test("Config.reviewer answers in place of the subprocess reviewer", async (t) => {
+  const asked: any[][] = [];
+  const config: Config = {
+    ...(await baseConfig(t, "--block-labels", "billing")),
+    reviewer: {
+      answer: async (questions) => {
+        asked.push(questions);
+        return { answers: { [databases.question]: "Postgres", [features.question]: "Billing" } };
+      },
+    },
+  };
+
+  const [record] = await replayQuestions(t, [databases], config);
+  assert.equal(record.answer, "Postgres");
+  assert.equal(asked.length, 1);
+
+  await assert.rejects(
+    replayQuestions(t, [features], config),
+    (error: unknown) => error instanceof RunError && error.kind === "blocked"
+  );
+});
+
+test("run() sends the reviewer's answer to a stub worker's question", async (t) => {
+  const responses = join(await tempDir(t), "responses.jsonl");
+  withEnv(t, { STUB_FIXTURE: fixture("question-stream.jsonl"), STUB_RESPONSES: responses });
+  const reviewer = await stub(t, "reviewer", "cat > /dev/null\nprintf 'ANSWER: 1: 2\\n'");
+  const config: Config = {
+    ...(await baseConfig(t, "--reviewer-cmd", reviewer, "--quiet", "--no-cache")),
+    claudeBin: stubClaude,
+  };
+
+  await run("pick a database", config);
+  const [response] = await readJsonLines(responses);
+  assert.equal(response.subtype, "success");
+  assert.equal(response.response.behavior, "allow");
+  assert.deepEqual(response.response.updatedInput.answers, { "Which database?": "MySQL" });
+  assert.equal(stats.questions, 1);
+  assert.equal(stats.answered, 1);
+});
+
+test("a worker that stops waiting stops its reviewer without a default", async (t) => {
+  withEnv(t, { STUB_FIXTURE: fixture("question-then-exit.jsonl") });
+  const reviewer = await stub(t, "reviewer", "cat > /dev/null\nsleep 10\nprintf 'ANSWER: 1: 2\\n'");
+  const config: Config = {
+    ...(await baseConfig(t, "--reviewer-cmd", reviewer, "--quiet", "--no-cache")),
+    defaultOption: "abort",
+    claudeBin: stubClaude,
+  };
+
+  const started = Date.now();
+  await assert.rejects(
+    run("pick a database", config),
+    (error: unknown) => error instanceof RunError && error.kind === "worker"
+  );
+  assert.ok(Date.now() - started < 5000, "the reviewer was not stopped");
+  assert.equal(stats.reviewerFailures, 0);
+  assert.equal(stats.defaulted, 0);
+});
+
+test("worker --add-dir takes several directories and may repeat", async (t) => {
+  const config = await baseConfig(t, "--", "--add-dir", "/a", "/b", "--add-dir=/c", "--debug");
+  assert.deepEqual(config.workerAddDirs, ["/a", "/b", "/c"]);
+  assert.deepEqual(config.workerArgs, { debug: null });
+  await assert.rejects(baseConfig(t, "--", "-v"), /worker flags must start with --/);
+});
@@ -0,0 +1,49 @@
+#!/usr/bin/env node
+// Stand-in for the claude CLI behind the agent SDK, for review.test.ts. It accepts
+// the SDK's control requests, waits for the prompt, then writes the stream-json
+// messages of the $STUB_FIXTURE file to stdout. A can_use_tool request waits for
+// the SDK's answer, which is appended to $STUB_RESPONSES, unless the fixture
+// cancels it on the next line, as a worker that stops waiting does.
+import { appendFileSync, readFileSync } from "node:fs";
+import { createInterface } from "node:readline";
+
+const fixture = readFileSync(process.env.STUB_FIXTURE ?? "", "utf-8")
+  .split("\n")
+  .filter((line) => line.trim() !== "")
+  .map((line) => JSON.parse(line));
+
+const send = (message) => process.stdout.write(JSON.stringify(message) + "\n");
+const answers = new Map();
+let prompted;
+const prompt = new Promise((resolve) => (prompted = resolve));
+
+createInterface({ input: process.stdin }).on("line", (line) => {
+  const message = JSON.parse(line);
+  if (message.type === "control_request") {
+    send({
+      type: "control_response",
+      response: { subtype: "success", request_id: message.request_id, response: {} },
+    });
+  } else if (message.type === "control_response") {
+    answers.get(message.response.request_id)?.(message.response);
+  } else if (message.type === "user") {
+    prompted();
+  }
+});
+
+await prompt;
+for (let i = 0; i < fixture.length; i++) {
+  const message = fixture[i];
+  if (message.type !== "control_request" || message.request.subtype !== "can_use_tool") {
+    send(message);
+    continue;
+  }
+  const answered = new Promise((resolve) => answers.set(message.request_id, resolve));
+  send(message);
+  const next = fixture[i + 1];
+  if (next?.type === "control_cancel_request" && next.request_id === message.request_id) {
+    continue;
+  }
+  appendFileSync(process.env.STUB_RESPONSES ?? "/dev/null", JSON.stringify(await answered) + "\n");
+}
+process.exit(0);